@@ -6,13 +6,18 @@ import (
 	"github.com/Kraust/nvim-server/server"
 	"log"
 	"os"
+	"strings"
 )
 
 var (
 	version = "dev"
 
-	f_address = flag.String("address", "127.0.0.1:9998", "Specifies the address to bind the server to.")
-	f_version = flag.Bool("version", false, "Show version information and exit.")
+	f_address          = flag.String("address", "127.0.0.1:9998", "Specifies the address to bind the server to.")
+	f_version          = flag.Bool("version", false, "Show version information and exit.")
+	f_token            = flag.String("token", "", "Bearer token required of websocket clients. Defaults to $NVIM_SERVER_TOKEN. Empty disables auth.")
+	f_cert             = flag.String("cert", "", "TLS certificate file. Requires -key; serves wss:// when set.")
+	f_key              = flag.String("key", "", "TLS private key file. Requires -cert.")
+	f_allowedAddresses = flag.String("allowed-addresses", "", "Comma-separated glob patterns (e.g. '127.0.0.1:*,unix:///run/user/1000/*') restricting which Neovim addresses clients may dial. Empty allows any address.")
 )
 
 func main() {
@@ -23,7 +28,27 @@ func main() {
 		os.Exit(0)
 	}
 
-	err := server.Serve(*f_address)
+	token := *f_token
+	if token == "" {
+		token = os.Getenv("NVIM_SERVER_TOKEN")
+	}
+
+	var allowedAddresses []string
+	if *f_allowedAddresses != "" {
+		allowedAddresses = strings.Split(*f_allowedAddresses, ",")
+	}
+
+	var err error
+	switch {
+	case *f_cert != "" || *f_key != "":
+		if *f_cert == "" || *f_key == "" {
+			log.Fatalf("-cert and -key must both be provided to serve TLS")
+		}
+		err = server.ServeTLS(*f_address, *f_cert, *f_key, token, allowedAddresses)
+	default:
+		err = server.Serve(*f_address, token, allowedAddresses)
+	}
+
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+const bearerSubprotocolPrefix = "bearer."
+
+// authorize reports whether r carries the server's bearer token, either as
+// a `?token=` query parameter or a `Sec-WebSocket-Protocol: bearer.<token>`
+// entry, compared in constant time. An empty ctx.token disables auth
+// entirely, matching the server's previous (trust-everyone) behavior.
+func (ctx *Server) authorize(r *http.Request) bool {
+	if ctx.token == "" {
+		return true
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		return secureCompare(token, ctx.token)
+	}
+
+	for _, proto := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(proto, bearerSubprotocolPrefix); ok {
+			return secureCompare(token, ctx.token)
+		}
+	}
+
+	return false
+}
+
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// addressAllowed reports whether address matches one of ctx.allowedAddresses,
+// a set of glob patterns such as "127.0.0.1:*" or "unix:///run/user/1000/*".
+// An empty pattern set allows any address, matching the server's previous
+// behavior.
+func (ctx *Server) addressAllowed(address string) bool {
+	if len(ctx.allowedAddresses) == 0 {
+		return true
+	}
+
+	for _, pattern := range ctx.allowedAddresses {
+		if matched, err := path.Match(pattern, address); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
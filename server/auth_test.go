@@ -0,0 +1,51 @@
+package server
+
+import "testing"
+
+func TestSecureCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want bool
+	}{
+		{"equal", "s3cret", "s3cret", true},
+		{"different", "s3cret", "other", false},
+		{"different length", "s3cret", "s3cretlonger", false},
+		{"both empty", "", "", true},
+		{"one empty", "s3cret", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := secureCompare(tt.a, tt.b); got != tt.want {
+				t.Errorf("secureCompare(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   []string
+		address   string
+		wantMatch bool
+	}{
+		{"empty allowlist permits anything", nil, "10.0.0.1:6666", true},
+		{"exact match", []string{"127.0.0.1:6666"}, "127.0.0.1:6666", true},
+		{"port glob matches", []string{"127.0.0.1:*"}, "127.0.0.1:7777", true},
+		{"port glob rejects other host", []string{"127.0.0.1:*"}, "10.0.0.1:7777", false},
+		{"unix socket glob matches", []string{"unix:///run/user/1000/*"}, "unix:///run/user/1000/nvim.sock", true},
+		{"no pattern matches", []string{"127.0.0.1:*", "unix:///run/user/1000/*"}, "10.0.0.1:6666", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &Server{allowedAddresses: tt.allowed}
+			if got := ctx.addressAllowed(tt.address); got != tt.wantMatch {
+				t.Errorf("addressAllowed(%q) with %v = %v, want %v", tt.address, tt.allowed, got, tt.wantMatch)
+			}
+		})
+	}
+}
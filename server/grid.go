@@ -0,0 +1,216 @@
+package server
+
+// GridState tracks the size and anchoring of one `ext_multigrid` grid, as
+// reported by grid_resize/grid_destroy/win_pos/win_float_pos/msg_set_pos
+// redraw events. Grid 1 is always the default grid; every other grid is a
+// floating window, a regular window split, the cmdline, or messages.
+type GridState struct {
+	Width        int
+	Height       int
+	Anchor       string // "window", "float", "message", or "" if unplaced
+	AnchorGrid   int
+	AnchorCorner string // NW/NE/SW/SE corner AnchorRow/AnchorCol are relative to; only set for Anchor == "float"
+	AnchorRow    int
+	AnchorCol    int
+	Focusable    bool
+}
+
+func gridEventName(update []any) (string, bool) {
+	if len(update) < 1 {
+		return "", false
+	}
+	name, ok := update[0].(string)
+	return name, ok
+}
+
+func asInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case uint64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+func asBool(v any) bool {
+	b, _ := v.(bool)
+	return b
+}
+
+// updateGridState applies every grid-layout-affecting event in batch to
+// shared.grids, returning true if the layout changed and subscribers
+// should be sent a fresh "grid_layout" message.
+func (ctx *Server) updateGridState(shared *SharedSession, batch []any) bool {
+	changed := false
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	for _, raw := range batch {
+		update, ok := raw.([]any)
+		if !ok {
+			continue
+		}
+
+		name, ok := gridEventName(update)
+		if !ok {
+			continue
+		}
+
+		switch name {
+		case "grid_resize":
+			if len(update) < 4 {
+				continue
+			}
+			gridID, ok1 := asInt(update[1])
+			width, ok2 := asInt(update[2])
+			height, ok3 := asInt(update[3])
+			if !ok1 || !ok2 || !ok3 {
+				continue
+			}
+
+			grid := shared.gridOrNew(gridID)
+			grid.Width = width
+			grid.Height = height
+			changed = true
+		case "grid_destroy":
+			if len(update) < 2 {
+				continue
+			}
+			gridID, ok := asInt(update[1])
+			if !ok {
+				continue
+			}
+
+			delete(shared.grids, gridID)
+			changed = true
+		case "win_pos":
+			if len(update) < 6 {
+				continue
+			}
+			gridID, ok1 := asInt(update[1])
+			startRow, ok2 := asInt(update[3])
+			startCol, ok3 := asInt(update[4])
+			if !ok1 || !ok2 || !ok3 {
+				continue
+			}
+
+			grid := shared.gridOrNew(gridID)
+			grid.Anchor = "window"
+			grid.AnchorRow = startRow
+			grid.AnchorCol = startCol
+			changed = true
+		case "win_float_pos":
+			if len(update) < 8 {
+				continue
+			}
+			gridID, ok1 := asInt(update[1])
+			anchorCorner, ok2 := update[3].(string)
+			anchorGrid, ok3 := asInt(update[4])
+			anchorRow, ok4 := asInt(update[5])
+			anchorCol, ok5 := asInt(update[6])
+			if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+				continue
+			}
+
+			grid := shared.gridOrNew(gridID)
+			grid.Anchor = "float"
+			grid.AnchorGrid = anchorGrid
+			grid.AnchorCorner = anchorCorner
+			grid.AnchorRow = anchorRow
+			grid.AnchorCol = anchorCol
+			grid.Focusable = asBool(update[7])
+			changed = true
+		case "msg_set_pos":
+			if len(update) < 3 {
+				continue
+			}
+			gridID, ok1 := asInt(update[1])
+			row, ok2 := asInt(update[2])
+			if !ok1 || !ok2 {
+				continue
+			}
+
+			grid := shared.gridOrNew(gridID)
+			grid.Anchor = "message"
+			grid.AnchorRow = row
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// gridOrNew returns the GridState for gridID, creating it if this is the
+// first event seen for that grid. Callers must hold shared.mu.
+func (shared *SharedSession) gridOrNew(gridID int) *GridState {
+	grid, ok := shared.grids[gridID]
+	if !ok {
+		grid = &GridState{}
+		shared.grids[gridID] = grid
+	}
+	return grid
+}
+
+// gridLayoutSnapshot returns the current layout of every grid in shared, in
+// the same shape broadcastGridLayout fans out to every subscriber — used
+// both for that broadcast and to catch up a single resuming client.
+func (shared *SharedSession) gridLayoutSnapshot() []map[string]any {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	grids := make([]map[string]any, 0, len(shared.grids))
+	for id, grid := range shared.grids {
+		grids = append(grids, map[string]any{
+			"id":            id,
+			"width":         grid.Width,
+			"height":        grid.Height,
+			"anchor":        grid.Anchor,
+			"anchor_grid":   grid.AnchorGrid,
+			"anchor_corner": grid.AnchorCorner,
+			"anchor_row":    grid.AnchorRow,
+			"anchor_col":    grid.AnchorCol,
+			"focusable":     grid.Focusable,
+		})
+	}
+
+	return grids
+}
+
+// broadcastGridLayout sends every subscriber a snapshot of the current
+// grid layout so the web client can composite floats, the cmdline, and
+// messages over the base grid.
+func (ctx *Server) broadcastGridLayout(shared *SharedSession) {
+	shared.broadcast(ctx, map[string]any{
+		"type":  "grid_layout",
+		"grids": shared.gridLayoutSnapshot(),
+	}, nil)
+}
+
+// attachUIOptions builds the nvim_ui_attach option set for a connect/
+// attach_ui request. ext_linegrid is always on and ext_multigrid defaults
+// to on; ext_cmdline, ext_popupmenu, ext_messages and ext_hlstate default
+// to off, so their event streams are only sent to clients that ask for them.
+func attachUIOptions(msg map[string]any) map[string]any {
+	boolOpt := func(key string, def bool) bool {
+		if v, ok := msg[key].(bool); ok {
+			return v
+		}
+		return def
+	}
+
+	return map[string]any{
+		"ext_linegrid":  true,
+		"ext_multigrid": boolOpt("ext_multigrid", true),
+		"ext_cmdline":   boolOpt("ext_cmdline", false),
+		"ext_popupmenu": boolOpt("ext_popupmenu", false),
+		"ext_messages":  boolOpt("ext_messages", false),
+		"ext_hlstate":   boolOpt("ext_hlstate", false),
+		"rgb":           true,
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	encodingJSON    = "json"
+	encodingMsgpack = "msgpack"
+
+	// redrawFlushInterval bounds how long a redraw update can sit queued
+	// before being coalesced and flushed to subscribers.
+	redrawFlushInterval = 16 * time.Millisecond
+
+	// redrawQueueSize is large enough to absorb a burst of grid_line
+	// events between ticks without the Neovim RPC goroutine blocking.
+	redrawQueueSize = 1024
+)
+
+// redrawCoalescer merges consecutive grid_line updates for the same grid
+// that arrive within a single flush tick, so a busy screen doesn't force
+// every intermediate frame out to slow clients.
+type redrawCoalescer struct {
+	events     []any
+	gridLineAt map[int]int
+}
+
+func newRedrawCoalescer() *redrawCoalescer {
+	return &redrawCoalescer{gridLineAt: make(map[int]int)}
+}
+
+func (q *redrawCoalescer) add(update []any) {
+	if gridID, ok := gridLineGridID(update); ok {
+		if idx, exists := q.gridLineAt[gridID]; exists {
+			q.events[idx] = update
+			return
+		}
+		q.gridLineAt[gridID] = len(q.events)
+	}
+
+	q.events = append(q.events, update)
+}
+
+func (q *redrawCoalescer) drain() []any {
+	events := q.events
+	q.events = nil
+	q.gridLineAt = make(map[int]int)
+	return events
+}
+
+// gridLineGridID returns the grid id a "grid_line" ui event targets.
+func gridLineGridID(update []any) (int, bool) {
+	if len(update) < 2 {
+		return 0, false
+	}
+
+	name, ok := update[0].(string)
+	if !ok || name != "grid_line" {
+		return 0, false
+	}
+
+	switch id := update[1].(type) {
+	case int:
+		return id, true
+	case int64:
+		return int(id), true
+	case uint64:
+		return int(id), true
+	}
+
+	return 0, false
+}
+
+// flushRedrawLoop coalesces queued redraw updates for shared and flushes
+// them to every subscriber at most once per redrawFlushInterval. Running
+// this in its own goroutine means a slow websocket write never blocks the
+// Neovim RPC goroutine feeding listenToNeovimEvents.
+func (ctx *Server) flushRedrawLoop(shared *SharedSession) {
+	ticker := time.NewTicker(redrawFlushInterval)
+	defer ticker.Stop()
+
+	queue := newRedrawCoalescer()
+
+	for {
+		select {
+		case update, ok := <-shared.redrawIn:
+			if !ok {
+				return
+			}
+			queue.add(update)
+		case <-ticker.C:
+			if batch := queue.drain(); len(batch) > 0 {
+				layoutChanged := ctx.updateGridState(shared, batch)
+
+				shared.mu.Lock()
+				shared.screen.observe(batch)
+				shared.mu.Unlock()
+
+				ctx.broadcastRedraw(shared, batch)
+				if layoutChanged {
+					ctx.broadcastGridLayout(shared)
+				}
+			}
+		case <-shared.stopFlush:
+			return
+		}
+	}
+}
+
+func (ctx *Server) broadcastRedraw(shared *SharedSession, batch []any) {
+	for _, sub := range shared.subscriberList() {
+		ctx.sendRedraw(sub, batch)
+	}
+}
+
+// sendRedraw delivers a coalesced redraw batch to session, using a binary
+// msgpack frame when the client negotiated it at connect time and falling
+// back to the regular JSON text frame otherwise.
+func (ctx *Server) sendRedraw(session *ClientSession, batch []any) {
+	if !session.active {
+		return
+	}
+
+	if session.encoding != encodingMsgpack {
+		ctx.sendToClient(session, map[string]any{
+			"type": "redraw",
+			"data": batch,
+		})
+		return
+	}
+
+	data, err := msgpack.Marshal(batch)
+	if err != nil {
+		log.Printf("Failed to encode redraw batch as msgpack: %v", err)
+		return
+	}
+
+	if err := session.writeMessage(websocket.BinaryMessage, data); err != nil {
+		log.Printf("Write error to client: %v", err)
+		session.writeMu.Lock()
+		session.active = false
+		if session.conn != nil {
+			session.conn.Close()
+		}
+		session.writeMu.Unlock()
+	}
+}
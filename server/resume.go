@@ -0,0 +1,150 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionIdleTTL is how long a ClientSession's Neovim attachment is kept
+// alive after its websocket drops, waiting for a "resume" to reclaim it.
+const sessionIdleTTL = 5 * time.Minute
+
+// newSession registers a fresh logical session for a newly upgraded
+// websocket connection. Its id is handed back in the "ready" message so
+// the client can reconnect to the same session later via "resume".
+func (ctx *Server) newSession(conn *websocket.Conn) (*ClientSession, error) {
+	id, err := generatePeerID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &ClientSession{
+		conn: conn,
+		id:   id,
+	}
+
+	ctx.mu.Lock()
+	ctx.clients[conn] = session
+	ctx.sessions[id] = session
+	ctx.mu.Unlock()
+
+	return session, nil
+}
+
+// resumeSession reattaches msg's session_id to conn, discarding scaffold
+// (the just-upgraded, not-yet-used session created for this connection).
+// It returns the resumed session, or nil if the resume was rejected, in
+// which case the caller should keep using scaffold.
+func (ctx *Server) resumeSession(scaffold *ClientSession, conn *websocket.Conn, msg map[string]any) *ClientSession {
+	sessionID, ok := msg["session_id"].(string)
+	if !ok {
+		scaffold.writeJSON(map[string]any{
+			"type": "error",
+			"data": "resume requires a session_id",
+		})
+		return nil
+	}
+
+	ctx.mu.Lock()
+	existing, found := ctx.sessions[sessionID]
+	if !found || existing == scaffold {
+		ctx.mu.Unlock()
+		scaffold.writeJSON(map[string]any{
+			"type": "error",
+			"data": "Unknown or expired session_id",
+		})
+		return nil
+	}
+
+	// idleTimer is only ever set/read/stopped under ctx.mu, so racing with
+	// expireSession (which also takes ctx.mu before acting on the session)
+	// can't fire the timer after we've stopped it here.
+	if existing.idleTimer != nil {
+		existing.idleTimer.Stop()
+		existing.idleTimer = nil
+	}
+	existing.conn = conn
+
+	delete(ctx.clients, scaffold.conn)
+	delete(ctx.sessions, scaffold.id)
+	ctx.clients[conn] = existing
+	ctx.mu.Unlock()
+
+	log.Printf("Session %s resumed on a new connection", existing.id)
+
+	existing.writeJSON(map[string]any{
+		"type":       "resumed",
+		"data":       "Resumed previous session",
+		"session_id": existing.id,
+	})
+
+	if existing.shared != nil {
+		ctx.sendToClient(existing, map[string]any{
+			"type":  "grid_layout",
+			"grids": existing.shared.gridLayoutSnapshot(),
+		})
+		ctx.sendCursorSnapshot(existing, existing.shared)
+		ctx.replayScreenState(existing.shared, existing)
+	}
+
+	return existing
+}
+
+// replayScreenState sends session the cached colors, highlight
+// definitions, grid sizes, and grid contents for shared, so it can repaint
+// without a full nvim_ui_detach/attach cycle.
+func (ctx *Server) replayScreenState(shared *SharedSession, session *ClientSession) {
+	shared.mu.Lock()
+	batch := shared.screen.replay()
+	shared.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx.sendRedraw(session, batch)
+}
+
+// disconnectSession is called when a websocket's read loop ends. A
+// session with no Neovim attachment is dropped immediately; one attached
+// to a SharedSession is kept registered for sessionIdleTTL so a later
+// "resume" can reclaim it without losing the Neovim instance.
+func (ctx *Server) disconnectSession(session *ClientSession) {
+	ctx.mu.Lock()
+	delete(ctx.clients, session.conn)
+	session.conn = nil
+
+	if session.shared == nil {
+		delete(ctx.sessions, session.id)
+		ctx.mu.Unlock()
+		return
+	}
+
+	// idleTimer must be set under the same lock resumeSession and
+	// expireSession use to read/stop/clear it, or a resume racing this
+	// disconnect could stop a timer that hasn't been assigned yet.
+	session.idleTimer = time.AfterFunc(sessionIdleTTL, func() {
+		ctx.expireSession(session)
+	})
+	ctx.mu.Unlock()
+
+	log.Printf("Session %s disconnected; keeping Neovim alive for %s", session.id, sessionIdleTTL)
+}
+
+// expireSession tears down a session's SharedSession attachment once it
+// has been disconnected for longer than sessionIdleTTL without a resume.
+func (ctx *Server) expireSession(session *ClientSession) {
+	ctx.mu.Lock()
+	current, ok := ctx.sessions[session.id]
+	if !ok || current != session || session.conn != nil {
+		ctx.mu.Unlock()
+		return
+	}
+	delete(ctx.sessions, session.id)
+	ctx.mu.Unlock()
+
+	log.Printf("Session %s expired after %s idle", session.id, sessionIdleTTL)
+	ctx.leaveSharedSession(session)
+}
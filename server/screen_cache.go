@@ -0,0 +1,235 @@
+package server
+
+import "sort"
+
+// screenCache accumulates enough of a SharedSession's redraw stream to
+// repaint a resuming client's grid without a full nvim_ui_detach/attach
+// cycle: the active color table, every highlight attribute definition
+// seen so far, and the latest contents of each grid row.
+type screenCache struct {
+	defaultColors []any
+	hlAttrDefine  map[int][]any
+	gridSizes     map[int]gridSize
+	gridLines     map[int]map[int][]gridCell
+}
+
+// gridCell is the decoded state of a single cell of a grid_line event: the
+// text it displays and the highlight group painting it.
+type gridCell struct {
+	text string
+	hlID int
+}
+
+// gridSize is the last-seen width/height from a grid_resize event, cached
+// so a resumed client can size its canvas before the replayed grid_line
+// batch arrives.
+type gridSize struct {
+	width  int
+	height int
+}
+
+func newScreenCache() *screenCache {
+	return &screenCache{
+		hlAttrDefine: make(map[int][]any),
+		gridSizes:    make(map[int]gridSize),
+		gridLines:    make(map[int]map[int][]gridCell),
+	}
+}
+
+// observe folds one redraw batch into the cache. Callers must hold the
+// owning SharedSession's mu.
+func (c *screenCache) observe(batch []any) {
+	for _, raw := range batch {
+		update, ok := raw.([]any)
+		if !ok {
+			continue
+		}
+
+		name, ok := gridEventName(update)
+		if !ok {
+			continue
+		}
+
+		switch name {
+		case "default_colors_set":
+			c.defaultColors = update
+		case "hl_attr_define":
+			if len(update) < 2 {
+				continue
+			}
+			if id, ok := asInt(update[1]); ok {
+				c.hlAttrDefine[id] = update
+			}
+		case "grid_resize":
+			if len(update) < 4 {
+				continue
+			}
+			gridID, ok1 := asInt(update[1])
+			width, ok2 := asInt(update[2])
+			height, ok3 := asInt(update[3])
+			if !ok1 || !ok2 || !ok3 {
+				continue
+			}
+			c.gridSizes[gridID] = gridSize{width: width, height: height}
+		case "grid_line":
+			c.observeGridLine(update)
+		case "grid_clear":
+			if len(update) < 2 {
+				continue
+			}
+			if gridID, ok := asInt(update[1]); ok {
+				delete(c.gridLines, gridID)
+			}
+		case "grid_destroy":
+			if len(update) < 2 {
+				continue
+			}
+			if gridID, ok := asInt(update[1]); ok {
+				delete(c.gridLines, gridID)
+				delete(c.gridSizes, gridID)
+			}
+		}
+	}
+}
+
+// observeGridLine merges one "grid_line" event into the cached row, which
+// only ever covers the column range Neovim actually redrew. Caching the raw
+// event instead of merging it would discard the rest of the row on the next
+// partial update for that row, so cells outside [startCol, startCol+len)
+// must be left untouched.
+func (c *screenCache) observeGridLine(update []any) {
+	if len(update) < 5 {
+		return
+	}
+
+	gridID, ok1 := asInt(update[1])
+	row, ok2 := asInt(update[2])
+	startCol, ok3 := asInt(update[3])
+	rawCells, ok4 := update[4].([]any)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return
+	}
+
+	rows, ok := c.gridLines[gridID]
+	if !ok {
+		rows = make(map[int][]gridCell)
+		c.gridLines[gridID] = rows
+	}
+
+	rows[row] = mergeGridLineCells(rows[row], startCol, rawCells)
+}
+
+// mergeGridLineCells applies a decoded run of grid_line cells onto row,
+// starting at startCol, growing row as needed and leaving every column
+// outside the run untouched. Each cell element is [text, hl_id?, repeat?];
+// an omitted hl_id repeats the previous cell's, and an omitted repeat means 1.
+func mergeGridLineCells(row []gridCell, startCol int, rawCells []any) []gridCell {
+	col := startCol
+	hlID := 0
+
+	for _, raw := range rawCells {
+		parts, ok := raw.([]any)
+		if !ok || len(parts) == 0 {
+			continue
+		}
+
+		text, _ := parts[0].(string)
+		if len(parts) > 1 {
+			if id, ok := asInt(parts[1]); ok {
+				hlID = id
+			}
+		}
+
+		repeat := 1
+		if len(parts) > 2 {
+			if r, ok := asInt(parts[2]); ok && r > 0 {
+				repeat = r
+			}
+		}
+
+		for i := 0; i < repeat; i++ {
+			for len(row) <= col {
+				row = append(row, gridCell{text: " "})
+			}
+			row[col] = gridCell{text: text, hlID: hlID}
+			col++
+		}
+	}
+
+	return row
+}
+
+// replay returns a single redraw batch that reconstructs the cached
+// screen: colors and highlight definitions first, then every grid row in
+// a stable order so the client repaints top-to-bottom per grid.
+func (c *screenCache) replay() []any {
+	var batch []any
+
+	if c.defaultColors != nil {
+		batch = append(batch, c.defaultColors)
+	}
+
+	for _, def := range c.hlAttrDefine {
+		batch = append(batch, def)
+	}
+
+	gridIDSet := make(map[int]struct{}, len(c.gridSizes)+len(c.gridLines))
+	for gridID := range c.gridSizes {
+		gridIDSet[gridID] = struct{}{}
+	}
+	for gridID := range c.gridLines {
+		gridIDSet[gridID] = struct{}{}
+	}
+
+	gridIDs := make([]int, 0, len(gridIDSet))
+	for gridID := range gridIDSet {
+		gridIDs = append(gridIDs, gridID)
+	}
+	sort.Ints(gridIDs)
+
+	for _, gridID := range gridIDs {
+		// grid_resize first so the client can size its canvas before the
+		// grid_line rows that follow arrive.
+		if size, ok := c.gridSizes[gridID]; ok {
+			batch = append(batch, []any{"grid_resize", gridID, size.width, size.height})
+		}
+
+		rows := c.gridLines[gridID]
+		rowNums := make([]int, 0, len(rows))
+		for row := range rows {
+			rowNums = append(rowNums, row)
+		}
+		sort.Ints(rowNums)
+
+		for _, row := range rowNums {
+			batch = append(batch, encodeGridLine(gridID, row, rows[row]))
+		}
+	}
+
+	return batch
+}
+
+// encodeGridLine re-serializes a cached row back into grid_line's wire
+// format, run-length encoding consecutive cells that share both text and
+// highlight so the replayed batch isn't needlessly larger than necessary.
+func encodeGridLine(gridID, row int, cells []gridCell) []any {
+	encoded := make([]any, 0, len(cells))
+
+	for col := 0; col < len(cells); {
+		cell := cells[col]
+		run := 1
+		for col+run < len(cells) && cells[col+run] == cell {
+			run++
+		}
+
+		entry := []any{cell.text, cell.hlID}
+		if run > 1 {
+			entry = append(entry, run)
+		}
+		encoded = append(encoded, entry)
+
+		col += run
+	}
+
+	return []any{"grid_line", gridID, row, 0, encoded}
+}
@@ -0,0 +1,157 @@
+package server
+
+import "testing"
+
+func cellsFromStrings(texts []string) []gridCell {
+	cells := make([]gridCell, len(texts))
+	for i, text := range texts {
+		cells[i] = gridCell{text: text}
+	}
+	return cells
+}
+
+func TestMergeGridLineCells(t *testing.T) {
+	tests := []struct {
+		name     string
+		row      []gridCell
+		startCol int
+		rawCells []any
+		want     []gridCell
+	}{
+		{
+			name:     "fills a fresh row",
+			row:      nil,
+			startCol: 0,
+			rawCells: []any{
+				[]any{"a", 1},
+				[]any{"b", 2},
+			},
+			want: []gridCell{{text: "a", hlID: 1}, {text: "b", hlID: 2}},
+		},
+		{
+			name:     "repeat expands into multiple cells",
+			row:      nil,
+			startCol: 0,
+			rawCells: []any{
+				[]any{" ", 0, 3},
+			},
+			want: []gridCell{{text: " "}, {text: " "}, {text: " "}},
+		},
+		{
+			name:     "omitted hl_id repeats the previous cell's",
+			row:      nil,
+			startCol: 0,
+			rawCells: []any{
+				[]any{"a", 5},
+				[]any{"b"},
+			},
+			want: []gridCell{{text: "a", hlID: 5}, {text: "b", hlID: 5}},
+		},
+		{
+			name:     "partial update leaves columns outside the run untouched",
+			row:      cellsFromStrings([]string{"a", "b", "c", "d"}),
+			startCol: 1,
+			rawCells: []any{
+				[]any{"X", 9},
+			},
+			want: []gridCell{{text: "a"}, {text: "X", hlID: 9}, {text: "c"}, {text: "d"}},
+		},
+		{
+			name:     "update past the end of the row grows it",
+			row:      cellsFromStrings([]string{"a"}),
+			startCol: 2,
+			rawCells: []any{
+				[]any{"c", 1},
+			},
+			want: []gridCell{{text: "a"}, {text: " "}, {text: "c", hlID: 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeGridLineCells(tt.row, tt.startCol, tt.rawCells)
+			if len(got) != len(tt.want) {
+				t.Fatalf("mergeGridLineCells() = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("cell %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScreenCacheReplay(t *testing.T) {
+	c := newScreenCache()
+
+	c.observe([]any{
+		[]any{"default_colors_set", 0, 0, 0},
+		[]any{"hl_attr_define", 1, map[string]any{}},
+		[]any{"grid_resize", 1, 80, 24},
+		[]any{"grid_line", 1, 0, 0, []any{[]any{"a", 1}, []any{"b"}}},
+	})
+
+	// A later partial update to the same row must merge, not overwrite.
+	c.observe([]any{
+		[]any{"grid_line", 1, 0, 1, []any{[]any{"X", 2}}},
+	})
+
+	batch := c.replay()
+	if len(batch) != 4 {
+		t.Fatalf("replay() returned %d events, want 4: %+v", len(batch), batch)
+	}
+
+	gotColors, ok := batch[0].([]any)
+	if !ok || gotColors[0] != "default_colors_set" {
+		t.Errorf("replay()[0] = %+v, want default_colors_set", batch[0])
+	}
+
+	gotHL, ok := batch[1].([]any)
+	if !ok || gotHL[0] != "hl_attr_define" {
+		t.Errorf("replay()[1] = %+v, want hl_attr_define", batch[1])
+	}
+
+	gotResize, ok := batch[2].([]any)
+	if !ok || gotResize[0] != "grid_resize" || gotResize[1] != 1 || gotResize[2] != 80 || gotResize[3] != 24 {
+		t.Errorf("replay()[2] = %+v, want grid_resize for grid 1 at 80x24", batch[2])
+	}
+
+	gotLine, ok := batch[3].([]any)
+	if !ok || gotLine[0] != "grid_line" {
+		t.Fatalf("replay()[3] = %+v, want grid_line", batch[3])
+	}
+	cells, ok := gotLine[4].([]any)
+	if !ok || len(cells) != 2 {
+		t.Fatalf("replayed grid_line cells = %+v, want 2 merged entries", gotLine[4])
+	}
+	first, _ := cells[0].([]any)
+	second, _ := cells[1].([]any)
+	if first[0] != "a" || first[1] != 1 {
+		t.Errorf("replayed cell 0 = %+v, want [a 1]", first)
+	}
+	if second[0] != "X" || second[1] != 2 {
+		t.Errorf("replayed cell 1 = %+v, want [X 2] (merged, not overwritten)", second)
+	}
+}
+
+func TestScreenCacheReplayEmpty(t *testing.T) {
+	c := newScreenCache()
+	if batch := c.replay(); len(batch) != 0 {
+		t.Errorf("replay() on an empty cache = %+v, want empty", batch)
+	}
+}
+
+func TestScreenCacheGridDestroyClearsSizeAndLines(t *testing.T) {
+	c := newScreenCache()
+
+	c.observe([]any{
+		[]any{"grid_resize", 1, 80, 24},
+		[]any{"grid_line", 1, 0, 0, []any{[]any{"a", 1}}},
+		[]any{"grid_destroy", 1},
+	})
+
+	if batch := c.replay(); len(batch) != 0 {
+		t.Errorf("replay() after grid_destroy = %+v, want empty", batch)
+	}
+}
@@ -4,96 +4,164 @@ import (
 	"embed"
 	"fmt"
 	"github.com/gorilla/websocket"
-	"github.com/neovim/go-client/nvim"
 	"io/fs"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
+// ClientSession is one browser tab's view onto a (possibly shared) Neovim
+// instance. Multiple ClientSessions can point at the same SharedSession
+// when several users connect to the same address or workspace.
 type ClientSession struct {
-	nvim       *nvim.Nvim
-	conn       *websocket.Conn
-	address    string
-	active     bool
-	uiAttached bool
+	conn      *websocket.Conn // nil while disconnected but within its idle TTL
+	writeMu   sync.Mutex      // serializes writes to conn; gorilla/websocket forbids concurrent writers
+	id        string
+	address   string
+	workspace string
+	color     string
+	encoding  string
+	active    bool
+	shared    *SharedSession
+	idleTimer *time.Timer
+}
+
+// writeJSON sends v as a JSON text frame on session's connection. It
+// serializes against every other writer of the same websocket.Conn (e.g.
+// flushRedrawLoop's sendRedraw running concurrently with a client message
+// handler), since gorilla/websocket panics on concurrent writes. It is a
+// no-op if the session currently has no live connection.
+func (session *ClientSession) writeJSON(v any) error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	if session.conn == nil {
+		return nil
+	}
+
+	return session.conn.WriteJSON(v)
+}
+
+// writeMessage sends a raw frame (e.g. a binary msgpack redraw batch) on
+// session's connection, under the same lock as writeJSON.
+func (session *ClientSession) writeMessage(messageType int, data []byte) error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
+	if session.conn == nil {
+		return nil
+	}
+
+	return session.conn.WriteMessage(messageType, data)
 }
 
 type Server struct {
-	upgrader websocket.Upgrader
-	clients  map[*websocket.Conn]*ClientSession
-	mu       sync.RWMutex
+	upgrader         websocket.Upgrader
+	clients          map[*websocket.Conn]*ClientSession
+	sharedSessions   map[string]*SharedSession
+	sessions         map[string]*ClientSession // logical sessions, kept alive across reconnects
+	token            string
+	allowedAddresses []string
+	mu               sync.RWMutex
 }
 
-func Serve(address string) error {
-	ctx := &Server{
+func newServer(token string, allowedAddresses []string) *Server {
+	return &Server{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
-		clients: make(map[*websocket.Conn]*ClientSession),
+		clients:          make(map[*websocket.Conn]*ClientSession),
+		sharedSessions:   make(map[string]*SharedSession),
+		sessions:         make(map[string]*ClientSession),
+		token:            token,
+		allowedAddresses: allowedAddresses,
 	}
+}
+
+func registerHandlers(ctx *Server) *http.ServeMux {
+	mux := http.NewServeMux()
 
 	staticFS, _ := fs.Sub(staticFiles, "static")
-	http.Handle("/", http.FileServer(http.FS(staticFS)))
+	mux.Handle("/", http.FileServer(http.FS(staticFS)))
+	mux.HandleFunc("/ws", ctx.handleWebSocket)
+
+	return mux
+}
 
-	http.HandleFunc("/ws", ctx.handleWebSocket)
+// Serve starts a plaintext (ws://) server on address. token, if non-empty,
+// is required from every websocket client (see authorize); allowedAddresses,
+// if non-empty, restricts which Neovim addresses a connect message may
+// dial (see addressAllowed).
+func Serve(address, token string, allowedAddresses []string) error {
+	ctx := newServer(token, allowedAddresses)
+	mux := registerHandlers(ctx)
 
 	log.Printf("Server starting on %s", address)
 
-	err := http.ListenAndServe(address, nil)
-	if err != nil {
-		return err
-	}
+	return http.ListenAndServe(address, mux)
+}
 
-	return nil
+// ServeTLS starts a TLS (wss://) server on address using certFile/keyFile.
+// token and allowedAddresses behave as in Serve.
+func ServeTLS(address, certFile, keyFile, token string, allowedAddresses []string) error {
+	ctx := newServer(token, allowedAddresses)
+	mux := registerHandlers(ctx)
+
+	log.Printf("Server starting on %s (TLS)", address)
+
+	return http.ListenAndServeTLS(address, certFile, keyFile, mux)
 }
 
-func (ctx *Server) listenToNeovimEvents(session *ClientSession) error {
-	session.nvim.RegisterHandler("redraw", func(updates ...[]any) {
-		if !session.active {
-			return
-		}
+func (ctx *Server) listenToNeovimEvents(shared *SharedSession) error {
+	shared.nvim.RegisterHandler("redraw", func(updates ...[]any) {
 		for _, update := range updates {
-			message := map[string]any{
-				"type": "redraw",
-				"data": update,
+			select {
+			case shared.redrawIn <- update:
+			default:
+				log.Printf("Dropping redraw update for %q: flush queue full", shared.key)
 			}
-			ctx.sendToClient(session, message)
 		}
 	})
 
-	if err := session.nvim.Subscribe("redraw"); err != nil {
+	if err := shared.nvim.Subscribe("redraw"); err != nil {
 		return fmt.Errorf("failed to subscribe to redraw events: %w", err)
 	}
 
-	err := session.nvim.Serve()
+	err := shared.nvim.Serve()
 
-	log.Printf("Neovim session closed for client")
+	log.Printf("Neovim session closed for %q", shared.key)
 
-	session.active = false
-	session.uiAttached = false // Reset UI state
-	ctx.sendToClient(session, map[string]any{
+	shared.setUIAttached(false)
+	shared.broadcast(ctx, map[string]any{
 		"type": "session_closed",
 		"data": "Neovim session has been closed",
-	})
+	}, nil)
 
 	return err
 }
 
 func (ctx *Server) sendToClient(session *ClientSession, message map[string]any) {
+	if session.conn == nil {
+		return
+	}
+
 	if !session.active && message["type"] != "session_closed" {
 		return
 	}
 
-	err := session.conn.WriteJSON(message)
-	if err != nil {
+	if err := session.writeJSON(message); err != nil {
 		log.Printf("Write error to client: %v", err)
-		session.active = false
-		session.conn.Close()
+		session.writeMu.Lock()
+		if session.conn != nil {
+			session.conn.Close()
+			session.conn = nil
+		}
+		session.writeMu.Unlock()
 	}
 }
 
@@ -109,7 +177,33 @@ func (ctx *Server) handleClientMessage(session *ClientSession, msg map[string]an
 			return
 		}
 
-		if err := ctx.connectSessionToNeovim(session, address); err != nil {
+		if address == discoveryAddress {
+			// Not yet connected, so bypass sendToClient's active gate the
+			// same way the initial "ready" message does.
+			session.writeJSON(map[string]any{
+				"type": "discovery",
+				"data": discoverNeovimSockets(),
+			})
+			return
+		}
+
+		if !ctx.addressAllowed(address) {
+			log.Printf("Rejected connect to disallowed address %s", address)
+			ctx.sendToClient(session, map[string]any{
+				"type": "error",
+				"data": "Address not permitted by server policy",
+			})
+			return
+		}
+
+		workspace, _ := msg["workspace"].(string)
+
+		session.encoding = encodingJSON
+		if encoding, ok := msg["encoding"].(string); ok && encoding == encodingMsgpack {
+			session.encoding = encodingMsgpack
+		}
+
+		if err := ctx.connectSessionToNeovim(session, address, workspace); err != nil {
 			log.Printf("Failed to connect client to Neovim at %s: %v", address, err)
 			ctx.sendToClient(session, map[string]any{
 				"type": "error",
@@ -122,17 +216,29 @@ func (ctx *Server) handleClientMessage(session *ClientSession, msg map[string]an
 			"type": "connected",
 			"data": "Successfully connected to Neovim",
 		})
+	case "cursor":
+		if !session.active || session.shared == nil {
+			return
+		}
+
+		row, rowOk := msg["row"].(float64)
+		col, colOk := msg["col"].(float64)
+		if !rowOk || !colOk {
+			return
+		}
+
+		ctx.broadcastCursor(session.shared, session, int(row), int(col))
 	case "clipboard_content":
-		if !session.active || session.nvim == nil {
+		if !session.active || session.shared == nil {
 			return
 		}
 
-		err := session.nvim.SetVar("nvim_server_clipboard", msg["data"])
+		err := session.shared.nvim.SetVar("nvim_server_clipboard", msg["data"])
 		if err != nil {
 			log.Printf("Failed to set clipboard variable: %v", err)
 		}
 	default:
-		if !session.active || session.nvim == nil {
+		if !session.active || session.shared == nil {
 			ctx.sendToClient(session, map[string]any{
 				"type": "error",
 				"data": "Not connected to Neovim",
@@ -145,7 +251,8 @@ func (ctx *Server) handleClientMessage(session *ClientSession, msg map[string]an
 }
 
 func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]any) {
-	if !session.active || session.nvim == nil {
+	shared := session.shared
+	if !session.active || shared == nil {
 		ctx.sendToClient(session, map[string]any{
 			"type": "error",
 			"data": "Neovim session is no longer active",
@@ -155,16 +262,18 @@ func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]an
 
 	switch msg["type"] {
 	case "attach_ui":
+		if !shared.tryClaimUIAttach() {
+			// A peer already picked the grid size; resync this late
+			// joiner instead of re-attaching the UI.
+			ctx.resyncSubscriber(session, shared)
+			return
+		}
+
 		width := int(msg["width"].(float64))
 		height := int(msg["height"].(float64))
-		options := map[string]any{
-			"ext_linegrid":  true,
-			"ext_multigrid": false,
-			"rgb":           true,
-		}
-		if err := session.nvim.AttachUI(width, height, options); err != nil {
+		if err := shared.nvim.AttachUI(width, height, attachUIOptions(msg)); err != nil {
 			log.Printf("Error attaching UI: %v", err)
-			session.uiAttached = false
+			shared.setUIAttached(false)
 			if strings.Contains(err.Error(), "session closed") {
 				session.active = false
 				ctx.sendToClient(session, map[string]any{
@@ -173,11 +282,11 @@ func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]an
 				})
 			}
 		} else {
-			session.uiAttached = true
+			shared.setUISize(width, height)
 		}
 	case "input":
 		input := msg["data"].(string)
-		if _, err := session.nvim.Input(input); err != nil {
+		if _, err := shared.nvim.Input(input); err != nil {
 			log.Printf("Error sending input: %v", err)
 			if strings.Contains(err.Error(), "session closed") {
 				session.active = false
@@ -191,42 +300,43 @@ func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]an
 		cmd := msg["data"].(string)
 
 		if strings.Contains(cmd, "nvim_ui_attach") {
-			if err := session.nvim.AttachUI(80, 24, map[string]any{
-				"ext_linegrid":  true,
-				"ext_multigrid": false,
-				"rgb":           true,
-			}); err != nil {
-				log.Printf("Error attaching UI: %v", err)
+			if shared.tryClaimUIAttach() {
+				if err := shared.nvim.AttachUI(80, 24, attachUIOptions(nil)); err != nil {
+					log.Printf("Error attaching UI: %v", err)
+					shared.setUIAttached(false)
+				}
 			}
 		} else if after, ok := strings.CutPrefix(cmd, "lua "); ok {
 			luaCode := after
-			if err := session.nvim.ExecLua(luaCode, nil); err != nil {
+			if err := shared.nvim.ExecLua(luaCode, nil); err != nil {
 				log.Printf("Error executing Lua: %v", err)
 			}
 		} else {
-			if err := session.nvim.Command(cmd); err != nil {
+			if err := shared.nvim.Command(cmd); err != nil {
 				log.Printf("Error executing command: %v", err)
 			}
 		}
 	case "resize":
-		if !session.uiAttached {
+		if !shared.isUIAttached() {
 			return
 		}
 
 		width := int(msg["width"].(float64))
 		height := int(msg["height"].(float64))
-		if err := session.nvim.TryResizeUI(width, height); err != nil {
+		if err := shared.nvim.TryResizeUI(width, height); err != nil {
 			log.Printf("Error resizing UI: %v", err)
 			if strings.Contains(err.Error(), "UI not attached") {
-				session.uiAttached = false
+				shared.setUIAttached(false)
 			} else if strings.Contains(err.Error(), "session closed") {
 				session.active = false
-				session.uiAttached = false
+				shared.setUIAttached(false)
 				ctx.sendToClient(session, map[string]any{
 					"type": "session_closed",
 					"data": "Neovim session has been closed",
 				})
 			}
+		} else {
+			shared.setUISize(width, height)
 		}
 	case "mouse":
 		action := msg["action"].(string)
@@ -257,7 +367,7 @@ func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]an
 		}
 
 		if input != "" {
-			if _, err := session.nvim.Input(input); err != nil {
+			if _, err := shared.nvim.Input(input); err != nil {
 				log.Printf("Error sending mouse input: %v", err)
 			}
 		}
@@ -273,7 +383,7 @@ func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]an
 			input = fmt.Sprintf("<ScrollWheelDown><%d,%d>", col, row)
 		}
 
-		if _, err := session.nvim.Input(input); err != nil {
+		if _, err := shared.nvim.Input(input); err != nil {
 			log.Printf("Error sending scroll input: %v", err)
 		}
 
@@ -281,7 +391,46 @@ func (ctx *Server) handleNeovimCommand(session *ClientSession, msg map[string]an
 
 }
 
+// resyncSubscriber brings a late-joining client's grid up to date by
+// forcing Neovim to emit a full redraw, which listenToNeovimEvents then
+// fans out to every subscriber including the one that just joined.
+func (ctx *Server) resyncSubscriber(session *ClientSession, shared *SharedSession) {
+	ctx.sendToClient(session, map[string]any{
+		"type": "connected",
+		"data": "Joined shared Neovim session",
+	})
+
+	ctx.sendCursorSnapshot(session, shared)
+
+	if _, err := shared.nvim.Input("<C-l>"); err != nil {
+		log.Printf("Failed to trigger resync redraw: %v", err)
+	}
+}
+
+// sendCursorSnapshot sends session every other peer's last-known cursor
+// position in shared, so a newly (re)joined client doesn't have to wait for
+// a peer to move before seeing where they already are.
+func (ctx *Server) sendCursorSnapshot(session *ClientSession, shared *SharedSession) {
+	for id, cursor := range shared.cursorSnapshot() {
+		if id == session.id {
+			continue
+		}
+		ctx.sendToClient(session, map[string]any{
+			"type":  "peer_cursor",
+			"id":    id,
+			"row":   cursor.Row,
+			"col":   cursor.Col,
+			"color": cursor.Color,
+		})
+	}
+}
+
 func (ctx *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !ctx.authorize(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := ctx.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
@@ -289,27 +438,16 @@ func (ctx *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	session := &ClientSession{
-		conn:   conn,
-		active: false,
+	session, err := ctx.newSession(conn)
+	if err != nil {
+		log.Printf("Failed to create session: %v", err)
+		return
 	}
 
-	ctx.mu.Lock()
-	ctx.clients[conn] = session
-	ctx.mu.Unlock()
-
-	defer func() {
-		ctx.mu.Lock()
-		if session.nvim != nil {
-			session.nvim.Close()
-		}
-		delete(ctx.clients, conn)
-		ctx.mu.Unlock()
-	}()
-
-	conn.WriteJSON(map[string]any{
-		"type": "ready",
-		"data": "WebSocket connected. Please provide Neovim server addresctx.",
+	session.writeJSON(map[string]any{
+		"type":       "ready",
+		"data":       "WebSocket connected. Please provide Neovim server addresctx.",
+		"session_id": session.id,
 	})
 
 	for {
@@ -320,32 +458,95 @@ func (ctx *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
+		if msg["type"] == "resume" {
+			// resumeSession already writes its own error/"resumed" message
+			// to the client on every outcome, so this branch must never
+			// fall through to handleClientMessage and send a second one.
+			if resumed := ctx.resumeSession(session, conn, msg); resumed != nil {
+				session = resumed
+			}
+			continue
+		}
+
 		ctx.handleClientMessage(session, msg)
 	}
+
+	ctx.disconnectSession(session)
+}
+
+// joinSharedSession attaches session to an already-running shared, sending
+// a resync if the grid is already attached so a late joiner catches up.
+func (ctx *Server) joinSharedSession(session *ClientSession, shared *SharedSession, address, workspace string) {
+	session.address = address
+	session.workspace = workspace
+	session.shared = shared
+	session.active = true
+
+	count := shared.addSubscriber(session)
+	log.Printf("Client joined shared Neovim session %q (%d subscribers)", shared.key, count)
+
+	if shared.isUIAttached() {
+		ctx.resyncSubscriber(session, shared)
+	}
 }
 
-func (ctx *Server) connectSessionToNeovim(session *ClientSession, address string) error {
-	if session.nvim != nil {
-		session.nvim.Close()
-		session.nvim = nil
+// connectSessionToNeovim attaches session to the SharedSession for key
+// (workspace if provided, otherwise address), dialing and creating a new
+// one if this is the first client to connect there.
+func (ctx *Server) connectSessionToNeovim(session *ClientSession, address, workspace string) error {
+	key := address
+	if workspace != "" {
+		key = workspace
+	}
+
+	ctx.mu.Lock()
+	if shared, exists := ctx.sharedSessions[key]; exists {
+		ctx.mu.Unlock()
+		ctx.joinSharedSession(session, shared, address, workspace)
+		return nil
 	}
+	ctx.mu.Unlock()
 
-	client, err := nvim.Dial(address)
+	client, err := dialNeovim(address)
 	if err != nil {
 		return fmt.Errorf("failed to dial %s: %w", address, err)
 	}
 
-	session.nvim = client
+	shared := newSharedSession(key, address, client)
+
+	ctx.mu.Lock()
+	if existing, exists := ctx.sharedSessions[key]; exists {
+		ctx.mu.Unlock()
+
+		// Another connect for the same key won the race while we were
+		// dialing; discard our own dial and join the session that won.
+		client.Close()
+		ctx.joinSharedSession(session, existing, address, workspace)
+		return nil
+	}
+	ctx.sharedSessions[key] = shared
+	ctx.mu.Unlock()
+
 	session.address = address
+	session.workspace = workspace
+	session.shared = shared
 	session.active = true
-	log.Printf("Successfully connected client to neovim at %s", address)
+	shared.addSubscriber(session)
+
+	log.Printf("Successfully connected client to neovim at %s (shared session %q)", address, key)
 
-	if err := ctx.setupClipboard(session); err != nil {
+	if err := ctx.setupCursorNamespace(shared); err != nil {
+		log.Printf("Failed to setup cursor namespace: %v", err)
+	}
+
+	if err := ctx.setupClipboard(shared); err != nil {
 		log.Printf("Failed to setup clipboard: %v", err)
 	}
 
+	go ctx.flushRedrawLoop(shared)
+
 	go func() {
-		if err := ctx.listenToNeovimEvents(session); err != nil {
+		if err := ctx.listenToNeovimEvents(shared); err != nil {
 			log.Printf("Error in Neovim event listener: %v", err)
 		}
 	}()
@@ -353,8 +554,34 @@ func (ctx *Server) connectSessionToNeovim(session *ClientSession, address string
 	return nil
 }
 
-func (ctx *Server) setupClipboard(session *ClientSession) error {
-	channelID := session.nvim.ChannelID()
+// leaveSharedSession removes session from its SharedSession, closing the
+// underlying Neovim instance only once the last subscriber has left.
+func (ctx *Server) leaveSharedSession(session *ClientSession) {
+	shared := session.shared
+	remaining := shared.removeSubscriber(session)
+
+	if remaining > 0 {
+		shared.broadcast(ctx, map[string]any{
+			"type": "peer_left",
+			"data": session.id,
+		}, nil)
+		return
+	}
+
+	ctx.mu.Lock()
+	if ctx.sharedSessions[shared.key] == shared {
+		delete(ctx.sharedSessions, shared.key)
+	}
+	ctx.mu.Unlock()
+
+	close(shared.stopFlush)
+
+	shared.nvim.Close()
+	log.Printf("Closed shared Neovim session %q (last client left)", shared.key)
+}
+
+func (ctx *Server) setupClipboard(shared *SharedSession) error {
+	channelID := shared.nvim.ChannelID()
 
 	clipboardConfig := fmt.Sprintf(`
 vim.g.clipboard = {
@@ -375,36 +602,36 @@ vim.g.clipboard = {
 	['+'] = function()
 	  vim.g.nvim_server_clipboard = nil
 	  vim.rpcnotify(%d, 'clipboard_paste')
-	  
+
 	  local timeout = 300
 	  while timeout > 0 and vim.g.nvim_server_clipboard == nil do
 		vim.wait(10)
 		timeout = timeout - 1
 	  end
-	  
+
 	  local content = vim.g.nvim_server_clipboard
 	  if content == nil or content == '' then
 		print('Clipboard paste timeout or empty')
 		return {''}
 	  end
-	  
+
 	  return vim.split(content, '\n', { plain = true })
 	end,
 	['*'] = function()
 	  vim.g.nvim_server_clipboard = nil
 	  vim.rpcnotify(%d, 'clipboard_paste')
-	  
+
 	  local timeout = 300
 	  while timeout > 0 and vim.g.nvim_server_clipboard == nil do
 		vim.wait(10)
 		timeout = timeout - 1
 	  end
-	  
+
 	  local content = vim.g.nvim_server_clipboard
 	  if content == nil or content == '' then
 		return {''}
 	  end
-	  
+
 	  return vim.split(content, '\n', { plain = true })
 	end,
   }
@@ -413,7 +640,7 @@ return true
 `, channelID, channelID, channelID, channelID)
 
 	var result bool
-	if err := session.nvim.ExecLua(clipboardConfig, &result); err != nil {
+	if err := shared.nvim.ExecLua(clipboardConfig, &result); err != nil {
 		return err
 	}
 
@@ -424,22 +651,23 @@ vim.opt.clipboard = 'unnamedplus'
 return true
 `
 
-	if err := session.nvim.ExecLua(reloadConfig, &result); err != nil {
+	if err := shared.nvim.ExecLua(reloadConfig, &result); err != nil {
 		return err
 	}
 
-	// Register message handlers
-	session.nvim.RegisterHandler("clipboard_copy", func(content string) {
-		ctx.sendToClient(session, map[string]any{
+	// Register message handlers. Any subscriber may service a clipboard
+	// round-trip, so broadcast to the whole shared session.
+	shared.nvim.RegisterHandler("clipboard_copy", func(content string) {
+		shared.broadcast(ctx, map[string]any{
 			"type": "clipboard_set",
 			"data": content,
-		})
+		}, nil)
 	})
 
-	session.nvim.RegisterHandler("clipboard_paste", func() {
-		ctx.sendToClient(session, map[string]any{
+	shared.nvim.RegisterHandler("clipboard_paste", func() {
+		shared.broadcast(ctx, map[string]any{
 			"type": "clipboard_get",
-		})
+		}, nil)
 	})
 
 	return nil
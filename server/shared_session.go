@@ -0,0 +1,251 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+const cursorNamespaceName = "nvim_server_cursors"
+
+// peerCursorColors is cycled through as clients join a shared session so
+// that concurrent collaborators get visually distinct remote cursors.
+var peerCursorColors = []string{
+	"#f43f5e", // rose
+	"#22c55e", // green
+	"#3b82f6", // blue
+	"#eab308", // yellow
+	"#a855f7", // purple
+	"#06b6d4", // cyan
+}
+
+// PeerCursor is the last known caret position for a subscriber of a
+// SharedSession, broadcast to peers as "peer_cursor" messages.
+type PeerCursor struct {
+	Row   int    `msgpack:"row"`
+	Col   int    `msgpack:"col"`
+	Color string `msgpack:"color"`
+
+	// extmarkID is the id SetBufferExtmark returned for this peer's last
+	// paint, reused on the next call so Neovim moves the existing mark
+	// instead of leaking a fresh one on every cursor update.
+	extmarkID int
+}
+
+// SharedSession is a single Neovim instance shared by every ClientSession
+// connected to the same address or workspace. Redraw events are fanned out
+// to every subscriber and the underlying `nvim.Nvim` is only closed once
+// the last subscriber leaves.
+type SharedSession struct {
+	key       string
+	nvim      *nvim.Nvim
+	address   string
+	namespace int
+
+	redrawIn  chan []any
+	stopFlush chan struct{}
+
+	mu          sync.Mutex
+	uiAttached  bool // true once AttachUI has succeeded; guards against a second client racing nvim_ui_attach
+	width       int
+	height      int
+	subscribers map[string]*ClientSession // keyed by ClientSession.id, stable across reconnects
+	cursors     map[string]PeerCursor
+	grids       map[int]*GridState
+	screen      *screenCache
+}
+
+func newSharedSession(key, address string, client *nvim.Nvim) *SharedSession {
+	return &SharedSession{
+		key:         key,
+		address:     address,
+		nvim:        client,
+		redrawIn:    make(chan []any, redrawQueueSize),
+		stopFlush:   make(chan struct{}),
+		screen:      newScreenCache(),
+		subscribers: make(map[string]*ClientSession),
+		grids:       make(map[int]*GridState),
+		cursors:     make(map[string]PeerCursor),
+	}
+}
+
+// addSubscriber registers session as a subscriber and assigns it a cursor
+// color, returning the number of subscribers now sharing the session.
+func (s *SharedSession) addSubscriber(session *ClientSession) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session.color = peerCursorColors[len(s.subscribers)%len(peerCursorColors)]
+	s.subscribers[session.id] = session
+
+	return len(s.subscribers)
+}
+
+// removeSubscriber drops session from the shared set and reports how many
+// subscribers remain, so the caller can decide whether to tear down nvim.
+func (s *SharedSession) removeSubscriber(session *ClientSession) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers, session.id)
+	delete(s.cursors, session.id)
+
+	return len(s.subscribers)
+}
+
+func (s *SharedSession) subscriberList() []*ClientSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]*ClientSession, 0, len(s.subscribers))
+	for _, sub := range s.subscribers {
+		sessions = append(sessions, sub)
+	}
+
+	return sessions
+}
+
+// broadcast fans a message out to every subscriber except the optional
+// excluded session (pass nil to reach everyone, including the sender).
+// Disconnected-but-not-yet-expired subscribers are silently skipped by
+// sendToClient, which no-ops once a session's conn is nil.
+func (s *SharedSession) broadcast(ctx *Server, message map[string]any, except *ClientSession) {
+	for _, sub := range s.subscriberList() {
+		if sub == except {
+			continue
+		}
+		ctx.sendToClient(sub, message)
+	}
+}
+
+// isUIAttached reports whether AttachUI has already succeeded for this
+// shared session.
+func (s *SharedSession) isUIAttached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.uiAttached
+}
+
+// setUIAttached updates the shared session's UI-attached flag.
+func (s *SharedSession) setUIAttached(attached bool) {
+	s.mu.Lock()
+	s.uiAttached = attached
+	s.mu.Unlock()
+}
+
+// tryClaimUIAttach atomically marks the shared session as UI-attached if it
+// wasn't already, reporting whether this call won the race. The caller that
+// wins is the one that should go on to call nvim.AttachUI; every other
+// concurrent caller should resync instead of attaching a second time.
+func (s *SharedSession) tryClaimUIAttach() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.uiAttached {
+		return false
+	}
+	s.uiAttached = true
+
+	return true
+}
+
+// setUISize records the grid dimensions Neovim was last attached/resized to.
+func (s *SharedSession) setUISize(width, height int) {
+	s.mu.Lock()
+	s.width = width
+	s.height = height
+	s.mu.Unlock()
+}
+
+// cursorSnapshot returns a copy of every peer cursor currently known for
+// the session, keyed by ClientSession.id, so a late (re)joiner can be
+// brought up to date on where everyone else's caret already is.
+func (s *SharedSession) cursorSnapshot() map[string]PeerCursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := make(map[string]PeerCursor, len(s.cursors))
+	for id, cursor := range s.cursors {
+		snapshot[id] = cursor
+	}
+
+	return snapshot
+}
+
+func generatePeerID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate peer id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// setupCursorNamespace creates the extmark namespace used to paint remote
+// cursors into the shared buffer so that anyone looking at the underlying
+// Neovim instance directly can also see collaborators' positions.
+func (ctx *Server) setupCursorNamespace(shared *SharedSession) error {
+	ns, err := shared.nvim.CreateNamespace(cursorNamespaceName)
+	if err != nil {
+		return fmt.Errorf("failed to create cursor namespace: %w", err)
+	}
+
+	shared.namespace = ns
+
+	return nil
+}
+
+// paintPeerCursor updates the extmark Neovim renders for a peer's cursor. It
+// reuses the extmark id from session's last paint (if any) so Neovim moves
+// the existing mark rather than creating a new one, then stores whatever id
+// SetBufferExtmark returns for reuse next time.
+func (ctx *Server) paintPeerCursor(shared *SharedSession, session *ClientSession, row, col int) {
+	buffer, err := shared.nvim.CurrentBuffer()
+	if err != nil {
+		return
+	}
+
+	shared.mu.Lock()
+	extmarkID := shared.cursors[session.id].extmarkID
+	shared.mu.Unlock()
+
+	opts := map[string]any{
+		"id":            extmarkID,
+		"virt_text":     [][]any{{"▏", "NvimServerPeerCursor"}},
+		"virt_text_pos": "overlay",
+	}
+
+	id, err := shared.nvim.SetBufferExtmark(buffer, shared.namespace, row, col, opts)
+	if err != nil {
+		return
+	}
+
+	shared.mu.Lock()
+	cursor := shared.cursors[session.id]
+	cursor.extmarkID = id
+	shared.cursors[session.id] = cursor
+	shared.mu.Unlock()
+}
+
+// broadcastCursor records session's cursor and broadcasts it to every other
+// subscriber of the shared session as a "peer_cursor" message.
+func (ctx *Server) broadcastCursor(shared *SharedSession, session *ClientSession, row, col int) {
+	shared.mu.Lock()
+	cursor := shared.cursors[session.id]
+	cursor.Row, cursor.Col, cursor.Color = row, col, session.color
+	shared.cursors[session.id] = cursor
+	shared.mu.Unlock()
+
+	shared.broadcast(ctx, map[string]any{
+		"type":  "peer_cursor",
+		"id":    session.id,
+		"row":   row,
+		"col":   col,
+		"color": session.color,
+	}, session)
+
+	ctx.paintPeerCursor(shared, session, row, col)
+}
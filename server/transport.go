@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neovim/go-client/nvim"
+)
+
+// discoveryAddress is the sentinel `connect` address that asks the server
+// to scan for local Neovim sockets instead of dialing anything.
+const discoveryAddress = "auto"
+
+// dialNeovim connects to address, which may be a TCP host:port (matching
+// nvim.Dial's own default), a `unix:///path/to/socket` URI, or (on
+// Windows) a `\\.\pipe\nvim-...` named pipe. This covers every form
+// Neovim itself writes to $NVIM_LISTEN_ADDRESS / v:servername.
+func dialNeovim(address string) (*nvim.Nvim, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		return nvim.Dial(path, nvim.DialNetDial(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}))
+	}
+
+	if isNamedPipe(address) {
+		return nvim.Dial(address, nvim.DialNetDial(func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialNamedPipe(ctx, address)
+		}))
+	}
+
+	return nvim.Dial(address)
+}
+
+func isNamedPipe(address string) bool {
+	return strings.HasPrefix(address, `\\.\pipe\`)
+}
+
+// discoverNeovimSockets scans $XDG_RUNTIME_DIR (falling back to the OS
+// temp directory, matching Neovim's own default on Windows) for the
+// `nvim.<host>.<pid>.0`-style sockets Neovim creates when it has no
+// explicit $NVIM_LISTEN_ADDRESS.
+func discoverNeovimSockets() []string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var sockets []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "nvim.") || !strings.HasSuffix(name, ".0") {
+			continue
+		}
+		sockets = append(sockets, fmt.Sprintf("unix://%s", filepath.Join(dir, name)))
+	}
+
+	return sockets
+}
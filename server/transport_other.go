@@ -0,0 +1,15 @@
+//go:build !windows
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// dialNamedPipe is unreachable outside Windows; isNamedPipe only matches
+// the `\\.\pipe\...` address form that Neovim never produces elsewhere.
+func dialNamedPipe(_ context.Context, address string) (net.Conn, error) {
+	return nil, fmt.Errorf("named pipe addresses are only supported on Windows: %s", address)
+}
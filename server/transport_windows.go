@@ -0,0 +1,17 @@
+//go:build windows
+
+package server
+
+import (
+	"context"
+	"net"
+
+	winio "github.com/Microsoft/go-winio"
+)
+
+// dialNamedPipe connects to a Windows named pipe such as
+// `\\.\pipe\nvim-12345-0`, which is how Neovim exposes its RPC socket on
+// Windows when no TCP $NVIM_LISTEN_ADDRESS is set.
+func dialNamedPipe(ctx context.Context, address string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, address)
+}